@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -41,7 +40,9 @@ func main() {
 	defer thisConfig.mmdbReader.Close()
 
 	// Then initialize cache with configured size
-	thisConfig.myCache, err = gonetcache.New[maxminddb.Result](thisConfig.myGetter, thisConfig.cacheSize)
+	thisConfig.myCache, err = gonetcache.NewWithOptions[maxminddb.Result](thisConfig.myGetter, thisConfig.cacheSize, gonetcache.Options{
+		NegativeTTL: 5 * time.Minute,
+	})
 	if err != nil {
 		log.Panicf("could not setup cache, err=[%s]", err)
 	}
@@ -52,7 +53,7 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/cached", thisConfig.cached)
 	mux.HandleFunc("/uncached", thisConfig.unCached)
-	mux.HandleFunc("/metrics", thisConfig.metrics) // Add metrics endpoint
+	mux.Handle("/metrics", thisConfig.myCache.PrometheusHandler())
 
 	srv := &http.Server{
 		Addr:    ":3333",
@@ -78,16 +79,6 @@ func main() {
 	}
 }
 
-func (c *config) metrics(w http.ResponseWriter, _ *http.Request) {
-	stats := c.myCache.GetStats()
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"hits":      stats.Hits,
-		"misses":    stats.Misses,
-		"evictions": stats.Evictions,
-		"hit_rate":  c.myCache.GetHitRate(),
-	})
-}
-
 func (c *config) monitorCache() {
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
@@ -150,6 +141,14 @@ func (c *config) respond(w http.ResponseWriter, _ *http.Request, result maxmindd
 
 func (c *config) myGetter(ipaddr netip.Addr) (maxminddb.Result, *net.IPNet) {
 	result := c.mmdbReader.Lookup(ipaddr)
+	if !result.Found() {
+		// No data for this address (e.g. private/reserved space in a City
+		// DB): report a nil network rather than letting Prefix().Bits()==0
+		// turn into a 0.0.0.0/0 catch-all, so gonetcache can negatively
+		// cache just the surrounding range instead of poisoning the tree.
+		return maxminddb.Result{}, nil
+	}
+
 	_, netRange, err := net.ParseCIDR(fmt.Sprintf("%s/%d", ipaddr.String(), result.Prefix().Bits()))
 	if err != nil {
 		fmt.Printf("could not parse CIDR, err=[%s]", err)
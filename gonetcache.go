@@ -1,271 +1,1074 @@
 package gonetcache
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"net"
 	"net/netip"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/leebrotherston/twinshrubnet"
 )
 
 const numShards = 32 // Must be power of 2
 
+// maxFreq is the saturating ceiling for an entry's access-frequency counter.
+const maxFreq = 3
+
 type UserSuppliedType[T any] any
 
-type cachePtr[T any] *cacheEntry[T]
+type queueKind int
+
+const (
+	queueNone queueKind = iota
+	queueSmall
+	queueMain
+)
 
 type cacheEntry[T any] struct {
-	prev    *cacheEntry[T]
-	next    *cacheEntry[T]
-	entry   *T
-	net     *net.IPNet
-	entryid int // just a way to track movement in the cache when debugging
+	prev       *cacheEntry[T]
+	next       *cacheEntry[T]
+	entry      *T
+	net        *net.IPNet
+	freq       atomic.Uint32
+	queue      queueKind
+	entryid    int // just a way to track movement in the cache when debugging
+	insertedAt time.Time
+	generation uint64
+	// negative marks an entry that records "Getter had no data for this
+	// network" rather than a real result; entry is left nil.
+	negative bool
+}
+
+// entryQueue is a simple intrusive doubly-linked FIFO: pushTop enqueues the
+// most recently admitted/requeued entry, popBottom dequeues the oldest.
+type entryQueue[T any] struct {
+	top    *cacheEntry[T]
+	bottom *cacheEntry[T]
+	size   int
+}
+
+func (q *entryQueue[T]) pushTop(e *cacheEntry[T]) {
+	e.prev = nil
+	e.next = q.top
+	if q.top != nil {
+		q.top.prev = e
+	}
+	q.top = e
+	if q.bottom == nil {
+		q.bottom = e
+	}
+	q.size++
+}
+
+func (q *entryQueue[T]) popBottom() *cacheEntry[T] {
+	e := q.bottom
+	if e == nil {
+		return nil
+	}
+	q.bottom = e.prev
+	if q.bottom != nil {
+		q.bottom.next = nil
+	} else {
+		q.top = nil
+	}
+	e.prev = nil
+	e.next = nil
+	q.size--
+	return e
+}
+
+// ghostQueue remembers the fingerprints of recently evicted Main-eligible
+// entries so that a re-admitted key skips straight past the Small queue.
+type ghostQueue struct {
+	capacity int
+	order    []uint64
+	member   map[uint64]struct{}
+}
+
+func newGhostQueue(capacity int) *ghostQueue {
+	return &ghostQueue{
+		capacity: capacity,
+		order:    make([]uint64, 0, capacity),
+		member:   make(map[uint64]struct{}, capacity),
+	}
+}
+
+func (g *ghostQueue) contains(fp uint64) bool {
+	_, ok := g.member[fp]
+	return ok
+}
+
+func (g *ghostQueue) remove(fp uint64) {
+	if _, ok := g.member[fp]; !ok {
+		return
+	}
+	delete(g.member, fp)
+	for i, o := range g.order {
+		if o == fp {
+			g.order = append(g.order[:i], g.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (g *ghostQueue) add(fp uint64) {
+	if _, ok := g.member[fp]; ok {
+		return
+	}
+	if g.capacity == 0 {
+		return
+	}
+	if len(g.order) >= g.capacity {
+		oldest := g.order[0]
+		g.order = g.order[1:]
+		delete(g.member, oldest)
+	}
+	g.order = append(g.order, fp)
+	g.member[fp] = struct{}{}
+}
+
+// fingerprint returns a compact hash of a string suitable for ghost-queue
+// and shard-routing lookups; it need not be cryptographically strong, just
+// cheap and well-distributed.
+func fingerprint(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
 }
 
 type CacheStats struct {
-	Hits      uint64
-	Misses    uint64
-	Evictions uint64
+	Hits         uint64
+	Misses       uint64
+	Evictions    uint64
+	NegativeHits uint64
+}
+
+// inflight deduplicates concurrent background refreshes for the same
+// network, so a burst of hits against a single almost-stale entry only
+// ever triggers one Getter call.
+type inflight struct {
+	mutex sync.Mutex
+	calls map[string]struct{}
+}
+
+// start reports whether the caller won the race to refresh key, marking it
+// in-flight if so.
+func (i *inflight) start(key string) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if _, ok := i.calls[key]; ok {
+		return false
+	}
+	if i.calls == nil {
+		i.calls = make(map[string]struct{})
+	}
+	i.calls[key] = struct{}{}
+	return true
+}
+
+func (i *inflight) done(key string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	delete(i.calls, key)
 }
 
+// shard is one independently-locked slice of the cache: its own tree, its
+// own S3-FIFO queues, its own stats. NetCache routes a given IP/network to
+// exactly one shard so that unrelated lookups never contend on the same
+// mutex.
+type shard[T any] struct {
+	cacheTree *twinshrubnet.TreeRoot[*cacheEntry[T]]
+	mutex     sync.RWMutex
+	stats     CacheStats
+
+	small      entryQueue[T]
+	main       entryQueue[T]
+	free       entryQueue[T]
+	ghost      *ghostQueue
+	smallCap   int
+	mainCap    int
+	refreshing inflight
+
+	// sink points at the owning NetCache's Sink field, so a caller that
+	// replaces it after construction is honoured by every shard.
+	sink *MetricsSink
+
+	// calls deduplicates concurrent Getter calls for the same address, so
+	// two goroutines racing on the same miss share one call instead of
+	// both hitting Getter.
+	callsMutex sync.Mutex
+	calls      map[string]*call[T]
+}
+
+// call is a Getter invocation in flight for a given address; other
+// goroutines that find one already running wait on done instead of
+// starting their own.
+type call[T any] struct {
+	done    chan struct{}
+	result  T
+	network *net.IPNet
+}
+
+func newShard[T any](capacity int) *shard[T] {
+	s := &shard[T]{
+		cacheTree: twinshrubnet.NewTree[*cacheEntry[T]](),
+		calls:     make(map[string]*call[T]),
+	}
+
+	// Small holds ~10% of capacity, Main the rest (each at least one slot,
+	// so an entry admitted into Main always has room there); Ghost tracks
+	// as many fingerprints as there are slots in this shard.
+	s.smallCap = capacity / 10
+	if s.smallCap < 1 {
+		s.smallCap = 1
+	}
+	s.mainCap = capacity - s.smallCap
+	if s.mainCap < 1 {
+		s.mainCap = 1
+	}
+	s.ghost = newGhostQueue(capacity)
+
+	// Pre-allocate every entry onto the free list; admission pulls from
+	// here first and only evicts once it runs dry.
+	for i := 0; i < capacity; i++ {
+		s.free.pushTop(&cacheEntry[T]{entryid: i})
+	}
+
+	return s
+}
+
+// NetCache implements a sharded S3-FIFO cache: new entries are admitted
+// into a small FIFO queue, survive a single hit to earn promotion into a
+// much larger main FIFO queue, and leave behind a ghost fingerprint on
+// eviction so a key that comes back soon is re-admitted straight into
+// Main. The cache is split across numShards independently-locked shards
+// so unrelated lookups don't serialize on one mutex.
 type NetCache[T any] struct {
-	cacheTree   *twinshrubnet.TreeRoot[*cacheEntry[T]]
-	cacheTop    *cacheEntry[T]
-	cacheBottom *cacheEntry[T]
-	mutex       *sync.RWMutex
-	Getter      func(netip.Addr) (T, *net.IPNet)
-	stats       CacheStats
-	maxSize     int
+	shards              [numShards]*shard[T]
+	Getter              func(netip.Addr) (T, *net.IPNet)
+	maxSize             int
+	ttl                 time.Duration
+	refreshAhead        time.Duration
+	negativeTTL         time.Duration
+	minNegativePrefixV4 int
+	minNegativePrefixV6 int
+	generation          atomic.Uint64
+
+	// Sink receives hit/miss/eviction events as they happen, in addition to
+	// the counters GetStats and PrometheusHandler already expose. It
+	// defaults to a no-op and can be reassigned to forward events to an
+	// external observability system.
+	Sink           MetricsSink
+	lookupDuration *histogram
+}
+
+// Options configures the optional behaviours available via NewWithOptions.
+// The zero value reproduces New's behaviour: entries never expire.
+type Options struct {
+	// TTL, when non-zero, makes an entry older than TTL invisible to
+	// Lookup - it is treated exactly like a cache miss.
+	TTL time.Duration
+	// RefreshAhead, when non-zero, makes an entry whose age is within
+	// RefreshAhead of TTL still servable, but kicks off a deduplicated
+	// background refresh of it so a later Lookup finds fresh data.
+	RefreshAhead time.Duration
+	// NegativeTTL, when non-zero, caches a Getter call that returned no
+	// network (no data for that address) for up to NegativeTTL so a burst
+	// of lookups against the same dead range doesn't repeatedly call
+	// Getter. Zero disables negative caching entirely.
+	NegativeTTL time.Duration
+	// MinNegativePrefixV4 and MinNegativePrefixV6 bound how large a
+	// negative entry's network can be, since Getter returning no network
+	// leaves no prefix of its own to cache against. They default to /24
+	// and /48 respectively, so one dead lookup only blackholes that
+	// surrounding range rather than the whole tree.
+	MinNegativePrefixV4 int
+	MinNegativePrefixV6 int
 }
 
+// New builds a cache that holds up to cacheSize entries, split evenly
+// across numShards shards. cacheSize is rounded up to the nearest
+// multiple of numShards (and up to numShards itself if smaller) so every
+// shard gets at least one slot; GetStats and the gonetcache_capacity
+// gauge report the rounded total, not the requested cacheSize.
 func New[T any](getter func(netip.Addr) (T, *net.IPNet), cacheSize int) (*NetCache[T], error) {
+	return NewWithOptions[T](getter, cacheSize, Options{})
+}
+
+// NewWithOptions is like New but additionally accepts TTL/refresh-ahead
+// behaviour via opts; see Options.
+func NewWithOptions[T any](getter func(netip.Addr) (T, *net.IPNet), cacheSize int, opts Options) (*NetCache[T], error) {
 	var newCache NetCache[T]
 
 	if cacheSize == 0 {
 		return nil, fmt.Errorf("cannot have cache size of 0")
 	}
 
-	newCache.cacheTree = twinshrubnet.NewTree[*cacheEntry[T]]()
-	newCache.mutex = new(sync.RWMutex)
 	newCache.Getter = getter
-	newCache.maxSize = cacheSize
-
-	// Create first entry
-	firstEntry := &cacheEntry[T]{
-		entryid: 0,
-		prev:    nil,
-		next:    nil,
-		net:     nil,
-		entry:   nil,
-	}
-	newCache.cacheTop = firstEntry
-
-	// Initialize remaining entries
-	current := firstEntry
-	for i := 1; i < cacheSize; i++ {
-		next := &cacheEntry[T]{
-			entryid: i,
-			prev:    current,
-			next:    nil,
-			net:     nil,
-			entry:   nil,
-		}
-		current.next = next
-		current = next
+	newCache.ttl = opts.TTL
+	newCache.refreshAhead = opts.RefreshAhead
+	newCache.negativeTTL = opts.NegativeTTL
+	newCache.minNegativePrefixV4 = opts.MinNegativePrefixV4
+	if newCache.minNegativePrefixV4 <= 0 {
+		newCache.minNegativePrefixV4 = 24
 	}
+	newCache.minNegativePrefixV6 = opts.MinNegativePrefixV6
+	if newCache.minNegativePrefixV6 <= 0 {
+		newCache.minNegativePrefixV6 = 48
+	}
+	newCache.Sink = noopMetricsSink{}
+	newCache.lookupDuration = newHistogram(defaultHistogramBuckets)
 
-	// Set the bottom of the cache to the last entry
-	newCache.cacheBottom = current
+	perShard := (cacheSize + numShards - 1) / numShards
+	if perShard < 1 {
+		perShard = 1
+	}
+	for i := range newCache.shards {
+		newCache.shards[i] = newShard[T](perShard)
+		newCache.shards[i].sink = &newCache.Sink
+	}
+	newCache.maxSize = perShard * numShards
 
 	return &newCache, nil
 }
 
+// Invalidate logically empties the cache in O(1): it bumps a generation
+// counter, and every entry stamped with an older generation is treated as
+// a miss the next time it's touched rather than being walked and removed
+// up front.
+func (c *NetCache[T]) Invalidate() {
+	c.generation.Add(1)
+}
+
+// shardFor routes a lookup to a shard by hashing the raw address bytes.
+// The matching network (and thus its prefix) isn't known until Getter
+// returns, so a miss is always resolved and stored back into the same
+// shard it was probed in rather than one derived from the network - this
+// keeps every address's probe and store shard in agreement, at the cost
+// of the odd network being cached redundantly in more than one shard when
+// two of its addresses happen to hash to different shards.
+func shardFor(key []byte) int {
+	return int(fingerprint(string(key)) & (numShards - 1))
+}
+
 // Lookup is compatible with MMDB's own Lookup function (per:
 // github.com/oschwald/maxminddb-golang/v2), with the difference being that it
 // uses a cache underneath the hood
 func (c *NetCache[T]) Lookup(ip netip.Addr) T {
+	result, _ := c.Lookup2(ip)
+	return result
+}
+
+// Lookup2 is Lookup, but also reports whether Getter ever had real data for
+// ip: false means either a fresh or cached negative result. For a cached
+// negative result, result is the zero value of T; for a fresh one it is
+// whatever Getter returned alongside its nil network.
+func (c *NetCache[T]) Lookup2(ip netip.Addr) (T, bool) {
+	myip := net.IP(ip.AsSlice())
+	shardIdx := shardFor(myip)
+	probe := c.shards[shardIdx]
+	generation := c.generation.Load()
+
+	result, found, ok, stale := c.probeServed(probe, shardIdx, myip, ip, generation)
+	if ok {
+		return result, found
+	}
+
+	getterResult, netRange := probe.singleFlightGetter(c, ip)
+	return c.completeMiss(probe, myip, stale, getterResult, netRange, generation)
+}
+
+// LookupCtx is Lookup, but abandons waiting on a cache miss if ctx expires
+// first. Getter itself takes no context and keeps running to completion in
+// the background - a call that's already in flight (whether started by this
+// call or deduplicated from a concurrent one) still populates the cache for
+// later callers - LookupCtx only stops the caller from blocking on it.
+func (c *NetCache[T]) LookupCtx(ctx context.Context, ip netip.Addr) (T, error) {
 	myip := net.IP(ip.AsSlice())
+	shardIdx := shardFor(myip)
+	probe := c.shards[shardIdx]
+	generation := c.generation.Load()
 
-	// Fast path - try read lock first
-	c.mutex.RLock()
-	entry, _, err := c.cacheTree.GetFromIP(myip)
+	result, _, ok, stale := c.probeServed(probe, shardIdx, myip, ip, generation)
+	if ok {
+		return result, nil
+	}
+
+	ch := make(chan T, 1)
+	go func() {
+		// Run to completion and populate the cache even if the caller below
+		// has already abandoned ctx - that's the whole point of decoupling
+		// Getter from the caller's deadline, per the doc comment above.
+		getterResult, netRange := probe.singleFlightGetter(c, ip)
+		result, _ := c.completeMiss(probe, myip, stale, getterResult, netRange, generation)
+		ch <- result
+	}()
+
+	select {
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	case result := <-ch:
+		return result, nil
+	}
+}
+
+// probeServed tries to serve ip from probe's existing tree contents: first
+// optimistically under an RLock, then, on a miss, again under the write
+// lock (which also bumps the miss counter). ok is false when Getter must be
+// consulted.
+func (c *NetCache[T]) probeServed(probe *shard[T], shardIdx int, myip net.IP, ip netip.Addr, generation uint64) (result T, found, ok bool, stale *cacheEntry[T]) {
+	// Fast path - try read lock first. Hits only bump an atomic frequency
+	// counter, so the RLock path never touches list pointers.
+	probe.mutex.RLock()
+	entry, _, err := probe.cacheTree.GetFromIP(myip)
 	if err == nil && entry != nil {
 		cacheEntry := entry.(*cacheEntry[T])
-		if cacheEntry.entry != nil {
-			result := *cacheEntry.entry
-			c.mutex.RUnlock()
-
-			// Async promotion to avoid blocking reads
-			go func() {
-				c.mutex.Lock()
-				c.cacheEntryPromote(cacheEntry)
-				c.mutex.Unlock()
-			}()
-
-			atomic.AddUint64(&c.stats.Hits, 1)
-			return result
+		if result, found, negative, needsRefresh, hit := c.serveEntry(cacheEntry, generation); hit {
+			probe.mutex.RUnlock()
+
+			bumpFreq(cacheEntry)
+			c.recordHit(probe, negative)
+			if needsRefresh {
+				c.triggerRefresh(shardIdx, ip, cacheEntry.net)
+			}
+			return result, found, true, nil
 		}
 	}
-	c.mutex.RUnlock()
+	probe.mutex.RUnlock()
 
-	// Cache miss path
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
-	// Double-check under write lock
-	entry, _, err = c.cacheTree.GetFromIP(myip)
+	// Cache miss path - double-check under write lock. A stale entry for
+	// this address (wrong generation, or past TTL) is remembered so a
+	// successful Getter call below can refresh it in place instead of
+	// leaving an orphaned node in the small/main queues.
+	probe.mutex.Lock()
+	entry, _, err = probe.cacheTree.GetFromIP(myip)
 	if err == nil && entry != nil {
 		cacheEntry := entry.(*cacheEntry[T])
-		if cacheEntry.entry != nil {
-			atomic.AddUint64(&c.stats.Hits, 1)
-			return *cacheEntry.entry
+		if result, found, negative, needsRefresh, hit := c.serveEntry(cacheEntry, generation); hit {
+			bumpFreq(cacheEntry)
+			c.recordHit(probe, negative)
+			probe.mutex.Unlock()
+			if needsRefresh {
+				c.triggerRefresh(shardIdx, ip, cacheEntry.net)
+			}
+			return result, found, true, nil
+		}
+		if cacheEntry.net != nil {
+			stale = cacheEntry
+		}
+	}
+	atomic.AddUint64(&probe.stats.Misses, 1)
+	probe.mutex.Unlock()
+
+	return result, false, false, stale
+}
+
+// completeMiss writes a Getter result for myip back into the cache: it
+// refreshes a known-stale entry in place if one was supplied and still
+// matches, admits a fresh entry otherwise, or - if network is nil and
+// negative caching is enabled - admits a negative entry covering the
+// smallest range this cache is configured to blackhole.
+func (c *NetCache[T]) completeMiss(probe *shard[T], myip net.IP, stale *cacheEntry[T], result T, network *net.IPNet, generation uint64) (T, bool) {
+	now := time.Now()
+
+	if network == nil {
+		if c.negativeTTL <= 0 {
+			log.Printf("Failed to cache entry: cannot add nil network to cache")
+			return result, false
 		}
+
+		negNet := negativeNetworkFor(myip, c.minNegativePrefixV4, c.minNegativePrefixV6)
+		probe.mutex.Lock()
+		if err := probe.addNegativeEntry(negNet, generation, now); err != nil {
+			log.Printf("Failed to cache negative entry: %v", err)
+		}
+		probe.mutex.Unlock()
+		return result, false
 	}
 
-	atomic.AddUint64(&c.stats.Misses, 1)
-	result, netRange := c.Getter(ip)
+	if stale != nil && refreshInPlace(probe, myip, stale, result, network, generation, now) {
+		return result, true
+	}
 
-	if err := c.addCacheEntry(result, netRange); err != nil {
+	// The entry is stored under probe - the same shard myip was just
+	// probed in - rather than one derived from network, so a later
+	// lookup of myip (or any other address that probes to this shard)
+	// is guaranteed to find it. Addresses in the same network that
+	// happen to probe to a different shard will cache the network again
+	// under that shard instead of sharing this entry - redundant memory
+	// use, but never a permanent miss.
+	probe.mutex.Lock()
+	if err := probe.addCacheEntry(result, network, generation, now); err != nil {
 		log.Printf("Failed to cache entry: %v", err)
 	}
+	probe.mutex.Unlock()
 
-	return result
+	return result, true
 }
 
-func (e *cacheEntry[T]) removeEntry() {
-	// Point the pointer to the result to nothing do that it can be garbage collected
-	e.entry = nil
-	e.net = nil
+// LookupN resolves a batch of addresses at once. Addresses are grouped by
+// shard so each shard's RLock (and, on a miss, its write lock) is taken
+// once for the whole group rather than once per address. Within a shard's
+// misses, once one address in the batch has resolved, any other miss
+// already covered by its network reuses that result instead of calling
+// Getter again - the common case for a batch drawn from the same
+// subnet - and every resulting admission for the shard is written back
+// under a single further write-lock acquisition. Getter calls for
+// addresses not sharing a resolved network with an earlier miss in this
+// batch still go through the same per-address single-flight mechanism as
+// Lookup, so an identical address raced concurrently from LookupN and/or
+// Lookup still only invokes Getter once.
+func (c *NetCache[T]) LookupN(ips []netip.Addr) []T {
+	results := make([]T, len(ips))
+	generation := c.generation.Load()
+
+	byShard := make(map[int][]int, numShards)
+	for i, ip := range ips {
+		shardIdx := shardFor(net.IP(ip.AsSlice()))
+		byShard[shardIdx] = append(byShard[shardIdx], i)
+	}
+
+	for shardIdx, idxs := range byShard {
+		c.lookupNShard(shardIdx, idxs, ips, results, generation)
+	}
+
+	return results
 }
 
-func (c *NetCache[T]) addCacheEntry(result T, network *net.IPNet) error {
-	if network == nil {
-		return fmt.Errorf("cannot add nil network to cache")
+// lookupNShard resolves the subset of a LookupN batch (idxs, indexing into
+// ips and results) that was routed to shardIdx.
+func (c *NetCache[T]) lookupNShard(shardIdx int, idxs []int, ips []netip.Addr, results []T, generation uint64) {
+	type pending struct {
+		idx   int
+		myip  net.IP
+		stale *cacheEntry[T]
 	}
 
-	// Already holding write lock from Lookup
+	probe := c.shards[shardIdx]
 
-	if c.cacheBottom == nil {
-		return fmt.Errorf("cache not properly initialized")
+	probe.mutex.RLock()
+	var misses []pending
+	for _, i := range idxs {
+		myip := net.IP(ips[i].AsSlice())
+		entry, _, err := probe.cacheTree.GetFromIP(myip)
+		if err == nil && entry != nil {
+			ce := entry.(*cacheEntry[T])
+			if result, _, negative, needsRefresh, hit := c.serveEntry(ce, generation); hit {
+				results[i] = result
+				bumpFreq(ce)
+				c.recordHit(probe, negative)
+				if needsRefresh {
+					c.triggerRefresh(shardIdx, ips[i], ce.net)
+				}
+				continue
+			}
+		}
+		misses = append(misses, pending{idx: i, myip: myip})
 	}
+	probe.mutex.RUnlock()
 
-	// Take a copy of the bottom entry while holding the lock
-	oldNetwork := c.cacheBottom.net
-	if oldNetwork != nil {
-		atomic.AddUint64(&c.stats.Evictions, 1)
-		// Remove from tree before modifying the entry
-		if err := c.cacheTree.RemoveNet(oldNetwork.String()); err != nil {
-			log.Printf("failed to remove network: %v", err)
+	if len(misses) == 0 {
+		return
+	}
+
+	// Double-check every miss under the write lock, same as Lookup: a hit
+	// here means another goroutine populated it since the RLock pass, and
+	// a stale entry is remembered so its slot can be refreshed in place.
+	probe.mutex.Lock()
+	trueMisses := misses[:0]
+	for _, p := range misses {
+		entry, _, err := probe.cacheTree.GetFromIP(p.myip)
+		if err == nil && entry != nil {
+			ce := entry.(*cacheEntry[T])
+			if result, _, negative, needsRefresh, hit := c.serveEntry(ce, generation); hit {
+				results[p.idx] = result
+				bumpFreq(ce)
+				c.recordHit(probe, negative)
+				if needsRefresh {
+					c.triggerRefresh(shardIdx, ips[p.idx], ce.net)
+				}
+				continue
+			}
+			if ce.net != nil {
+				p.stale = ce
+			}
 		}
+		atomic.AddUint64(&probe.stats.Misses, 1)
+		trueMisses = append(trueMisses, p)
 	}
+	probe.mutex.Unlock()
 
-	// Take the bottom entry
-	newEntry := c.cacheBottom
+	// Resolve each remaining miss, grouping fresh admissions by resolved
+	// network so a network seen more than once in this batch is only
+	// written once. A miss already covered by a network resolved earlier
+	// in this same batch reuses that result instead of calling Getter
+	// again - the common case for a batch of addresses drawn from the
+	// same subnet.
+	type group struct {
+		result   T
+		network  *net.IPNet
+		negative bool
+	}
+	groups := make(map[string]group)
+	var order []string
+	var resolved []group
+	now := time.Now()
 
-	// Update the cache bottom
-	c.cacheBottom = c.cacheBottom.prev
-	if c.cacheBottom != nil {
-		c.cacheBottom.next = nil
+	coveredBy := func(myip net.IP) (group, bool) {
+		for _, g := range resolved {
+			if !g.negative && g.network.Contains(myip) {
+				return g, true
+			}
+		}
+		return group{}, false
 	}
 
-	// Update the entry contents
-	newEntry.net = network
-	newEntry.entry = &result
+	for _, p := range trueMisses {
+		if g, ok := coveredBy(p.myip); ok {
+			results[p.idx] = g.result
+			continue
+		}
 
-	// Add to tree
-	_, err := c.cacheTree.AddNet(network.String(), newEntry)
-	if err != nil {
-		return fmt.Errorf("could not add cache entry: %v", err)
+		result, network := probe.singleFlightGetter(c, ips[p.idx])
+		results[p.idx] = result
+
+		negative := network == nil
+		if negative {
+			if c.negativeTTL <= 0 {
+				log.Printf("Failed to cache entry: cannot add nil network to cache")
+				continue
+			}
+			network = negativeNetworkFor(p.myip, c.minNegativePrefixV4, c.minNegativePrefixV6)
+		} else if p.stale != nil && refreshInPlace(probe, p.myip, p.stale, result, network, generation, now) {
+			resolved = append(resolved, group{result: result, network: network})
+			continue
+		}
+
+		g := group{result: result, network: network, negative: negative}
+		resolved = append(resolved, g)
+
+		key := network.String()
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = g
 	}
 
-	// Move to top
-	c.cacheEntryPromote(newEntry)
+	// Every group is written to probe - the same shard all of idxs was
+	// just probed in - rather than one derived from network, so a later
+	// lookup of any of these addresses is guaranteed to find it.
+	if len(order) > 0 {
+		probe.mutex.Lock()
+		for _, key := range order {
+			g := groups[key]
 
-	return nil
+			var err error
+			if g.negative {
+				err = probe.addNegativeEntry(g.network, generation, now)
+			} else {
+				err = probe.addCacheEntry(g.result, g.network, generation, now)
+			}
+			if err != nil {
+				log.Printf("Failed to cache entry: %v", err)
+			}
+		}
+		probe.mutex.Unlock()
+	}
 }
 
-func (c *NetCache[T]) cacheEntryPromote(entry *cacheEntry[T]) {
-	if entry == nil {
-		return
+// serveEntry reports whether cacheEntry currently holds a usable answer for
+// generation: ok is true for any in-generation, within-TTL entry (including
+// negative ones); found is additionally true only when it holds real data.
+func (c *NetCache[T]) serveEntry(e *cacheEntry[T], generation uint64) (result T, found, negative, needsRefresh, ok bool) {
+	if e.net == nil || e.generation != generation {
+		return result, false, false, false, false
 	}
+	servable, refresh := c.classify(e)
+	if !servable {
+		return result, false, false, false, false
+	}
+	if e.negative {
+		return result, false, true, refresh, true
+	}
+	return *e.entry, true, false, refresh, true
+}
 
-	// If it's already at the top, nothing to do
-	if entry == c.cacheTop {
-		return
+// recordHit bumps the hit (or negative-hit) counter for a shard.
+func (c *NetCache[T]) recordHit(s *shard[T], negative bool) {
+	if negative {
+		atomic.AddUint64(&s.stats.NegativeHits, 1)
+	} else {
+		atomic.AddUint64(&s.stats.Hits, 1)
 	}
+	c.Sink.ObserveHit()
+}
 
-	// Update previous and next links
-	if entry.prev != nil {
-		entry.prev.next = entry.next
+// negativeNetworkFor derives the network a negative cache entry should be
+// keyed to when Getter had no network of its own to report: myip masked
+// down to minPrefixV4/minPrefixV6 bits, so a single no-data lookup only
+// blackholes that surrounding range.
+func negativeNetworkFor(myip net.IP, minPrefixV4, minPrefixV6 int) *net.IPNet {
+	if v4 := myip.To4(); v4 != nil {
+		mask := net.CIDRMask(minPrefixV4, 32)
+		return &net.IPNet{IP: v4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(minPrefixV6, 128)
+	return &net.IPNet{IP: myip.Mask(mask), Mask: mask}
+}
+
+// classify reports whether an entry is still servable and, if so, whether
+// it's old enough that a background refresh should be kicked off. With no
+// TTL configured every entry is always servable and never needs refresh.
+// Negative entries use NegativeTTL instead of TTL and never refresh ahead -
+// there's nothing to refresh in the background, since there was no data.
+func (c *NetCache[T]) classify(e *cacheEntry[T]) (servable, needsRefresh bool) {
+	ttl := c.ttl
+	if e.negative {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return true, false
 	}
-	if entry.next != nil {
-		entry.next.prev = entry.prev
+	age := time.Since(e.insertedAt)
+	if age > ttl {
+		return false, false
 	}
+	if !e.negative && c.refreshAhead > 0 && age > ttl-c.refreshAhead {
+		return true, true
+	}
+	return true, false
+}
 
-	// If this was the bottom entry, update bottom pointer
-	if entry == c.cacheBottom {
-		c.cacheBottom = entry.prev
-		if c.cacheBottom != nil {
-			c.cacheBottom.next = nil
-		}
+// refreshInPlace overwrites a known-stale entry with a freshly fetched
+// result, reusing its existing tree/queue position instead of evicting and
+// re-admitting it. It re-validates under the write lock that the entry is
+// still the one mapped to myip for the same network, since the Getter call
+// that produced result runs unlocked and the entry may have moved on in
+// the meantime; on any mismatch it declines so the caller falls back to a
+// normal admission.
+func refreshInPlace[T any](s *shard[T], myip net.IP, stale *cacheEntry[T], result T, network *net.IPNet, generation uint64, now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, _, err := s.cacheTree.GetFromIP(myip)
+	if err != nil || entry == nil {
+		return false
+	}
+	current := entry.(*cacheEntry[T])
+	if current != stale || current.net == nil || current.net.String() != network.String() {
+		return false
 	}
 
-	// Move to top
-	entry.prev = nil
-	entry.next = c.cacheTop
-	if c.cacheTop != nil {
-		c.cacheTop.prev = entry
+	current.entry = &result
+	current.net = network
+	current.negative = false
+	current.insertedAt = now
+	current.generation = generation
+	return true
+}
+
+// singleFlightGetter calls c.Getter for ip, except that a concurrent call
+// already in flight for the same address is waited on and its result
+// reused instead of calling Getter again. Only the winning caller measures
+// and reports lookup latency.
+//
+// This dedupes exact repeats of the same address; it does not dedupe two
+// concurrent callers resolving different addresses that happen to share a
+// network, since the network isn't known until Getter returns for at
+// least one of them. Within a single LookupN batch that case is instead
+// handled by lookupNShard's own network-containment check once the first
+// address in the group has resolved.
+func (s *shard[T]) singleFlightGetter(c *NetCache[T], ip netip.Addr) (T, *net.IPNet) {
+	key := ip.String()
+
+	s.callsMutex.Lock()
+	if existing, ok := s.calls[key]; ok {
+		s.callsMutex.Unlock()
+		<-existing.done
+		return existing.result, existing.network
 	}
-	c.cacheTop = entry
+	cl := &call[T]{done: make(chan struct{})}
+	s.calls[key] = cl
+	s.callsMutex.Unlock()
+	defer func() {
+		s.callsMutex.Lock()
+		delete(s.calls, key)
+		s.callsMutex.Unlock()
+		close(cl.done)
+	}()
+
+	getterStart := time.Now()
+	result, network := c.Getter(ip)
+	latency := time.Since(getterStart)
+	c.lookupDuration.observe(latency.Seconds())
+	c.Sink.ObserveMiss(latency)
+
+	cl.result = result
+	cl.network = network
+
+	return result, network
 }
 
-func isFirst[T any](entry *cacheEntry[T]) bool {
-	if entry.prev == nil {
-		return true
+// triggerRefresh kicks off a deduplicated background refresh of network on
+// shardIdx, calling Getter again and writing the result back in place once
+// it returns.
+func (c *NetCache[T]) triggerRefresh(shardIdx int, ip netip.Addr, network *net.IPNet) {
+	if network == nil {
+		return
 	}
-	return false
+	s := c.shards[shardIdx]
+	key := network.String()
+	if !s.refreshing.start(key) {
+		return
+	}
+
+	go func() {
+		defer s.refreshing.done(key)
+
+		result, newNet := c.Getter(ip)
+		if newNet == nil {
+			return
+		}
+
+		myip := net.IP(ip.AsSlice())
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		entry, _, err := s.cacheTree.GetFromIP(myip)
+		if err != nil || entry == nil {
+			return
+		}
+		current := entry.(*cacheEntry[T])
+		if current.net == nil || current.net.String() != newNet.String() {
+			return
+		}
+
+		current.entry = &result
+		current.insertedAt = time.Now()
+		current.generation = c.generation.Load()
+	}()
 }
 
-func isLast[T any](entry *cacheEntry[T]) bool {
-	if entry.next == nil {
-		return true
+// bumpFreq saturates an entry's frequency counter at maxFreq.
+func bumpFreq[T any](e *cacheEntry[T]) {
+	for {
+		old := e.freq.Load()
+		if old >= maxFreq {
+			return
+		}
+		if e.freq.CompareAndSwap(old, old+1) {
+			return
+		}
 	}
-	return false
 }
 
-func getID[T any](entry *cacheEntry[T]) int {
-	if entry == nil {
-		return 100
+// addCacheEntry admits a freshly fetched result into the shard: straight
+// into Main if its network is still in the ghost queue, otherwise into
+// Small. Already holding the shard's write lock.
+func (s *shard[T]) addCacheEntry(result T, network *net.IPNet, generation uint64, insertedAt time.Time) error {
+	return s.admit(network, &result, false, generation, insertedAt)
+}
+
+// addNegativeEntry admits a marker recording that Getter had no data for
+// network, so repeat lookups against it don't keep re-calling Getter.
+// Already holding the shard's write lock.
+func (s *shard[T]) addNegativeEntry(network *net.IPNet, generation uint64, insertedAt time.Time) error {
+	return s.admit(network, nil, true, generation, insertedAt)
+}
+
+// admit is the shared admission path for both real and negative entries:
+// pull a slot from the free list (evicting if necessary), index it by
+// network in the tree, and queue it into Small or, if its network is still
+// in the ghost queue, straight into Main.
+func (s *shard[T]) admit(network *net.IPNet, result *T, negative bool, generation uint64, insertedAt time.Time) error {
+	if network == nil {
+		return fmt.Errorf("cannot add nil network to cache")
+	}
+
+	if s.free.size == 0 {
+		s.evictOne()
+	}
+
+	newEntry := s.free.popBottom()
+	if newEntry == nil {
+		return fmt.Errorf("cache not properly initialized")
+	}
+
+	newEntry.net = network
+	newEntry.entry = result
+	newEntry.negative = negative
+	newEntry.freq.Store(0)
+	newEntry.generation = generation
+	newEntry.insertedAt = insertedAt
+
+	if _, err := s.cacheTree.AddNet(network.String(), newEntry); err != nil {
+		newEntry.net = nil
+		newEntry.entry = nil
+		newEntry.negative = false
+		s.free.pushTop(newEntry)
+		return fmt.Errorf("could not add cache entry: %v", err)
+	}
+
+	fp := fingerprint(network.String())
+	if s.ghost.contains(fp) {
+		s.ghost.remove(fp)
+		newEntry.queue = queueMain
+		s.main.pushTop(newEntry)
+		s.enforceMainCap()
 	} else {
-		return entry.entryid
+		newEntry.queue = queueSmall
+		s.small.pushTop(newEntry)
+		s.enforceSmallCap()
+	}
+
+	return nil
+}
+
+// enforceSmallCap keeps Small within smallCap as soon as admission pushes it
+// over, independent of whether the shard as a whole still has free slots -
+// this is what actually keeps a flood of one-hit wonders from sitting in
+// Small long enough to threaten Main, rather than leaving Small free to grow
+// until the whole shard is full. A victim with freq>0 is promoted into Main
+// (same rule as evictOne), which can in turn push Main over mainCap.
+func (s *shard[T]) enforceSmallCap() {
+	for s.small.size > s.smallCap {
+		victim := s.small.popBottom()
+		if victim.freq.Load() > 0 {
+			victim.freq.Store(0)
+			victim.queue = queueMain
+			s.main.pushTop(victim)
+			s.enforceMainCap()
+			continue
+		}
+		s.evict(victim)
+	}
+}
+
+// enforceMainCap keeps Main within mainCap the same way, requeuing a
+// not-yet-cold entry with its frequency decremented rather than evicting it
+// outright - same rule as evictOne's Main case.
+func (s *shard[T]) enforceMainCap() {
+	for s.main.size > s.mainCap {
+		victim := s.main.popBottom()
+		if freq := victim.freq.Load(); freq > 0 {
+			victim.freq.Store(freq - 1)
+			s.main.pushTop(victim)
+			continue
+		}
+		s.evict(victim)
+	}
+}
+
+// evictOne frees exactly one slot, following the S3-FIFO eviction rule:
+// a Small-queue entry with freq>0 is promoted into Main instead of being
+// evicted, and a Main-queue entry with freq>0 is requeued with freq
+// decremented, so this may walk several entries before one is actually
+// evicted.
+func (s *shard[T]) evictOne() {
+	for {
+		switch {
+		case s.small.size > 0:
+			victim := s.small.popBottom()
+			if victim.freq.Load() > 0 {
+				victim.freq.Store(0)
+				victim.queue = queueMain
+				s.main.pushTop(victim)
+				continue
+			}
+			s.evict(victim)
+			return
+		case s.main.size > 0:
+			victim := s.main.popBottom()
+			if freq := victim.freq.Load(); freq > 0 {
+				victim.freq.Store(freq - 1)
+				s.main.pushTop(victim)
+				continue
+			}
+			s.evict(victim)
+			return
+		default:
+			return
+		}
+	}
+}
+
+// evict removes a victim entry from the tree, records its fingerprint in
+// the ghost queue, and returns it to the free list.
+func (s *shard[T]) evict(victim *cacheEntry[T]) {
+	if victim.net != nil {
+		if err := s.cacheTree.RemoveNet(victim.net.String()); err != nil {
+			log.Printf("failed to remove network: %v", err)
+		}
+		s.ghost.add(fingerprint(victim.net.String()))
+	}
+
+	victim.entry = nil
+	victim.net = nil
+	victim.negative = false
+	victim.freq.Store(0)
+	victim.queue = queueNone
+	s.free.pushTop(victim)
+
+	atomic.AddUint64(&s.stats.Evictions, 1)
+	if s.sink != nil {
+		(*s.sink).ObserveEviction()
 	}
 }
 
-// GetStats returns the current cache statistics atomically
+// GetStats returns the current cache statistics, aggregated atomically
+// across all shards
 func (c *NetCache[T]) GetStats() CacheStats {
-	return CacheStats{
-		Hits:      atomic.LoadUint64(&c.stats.Hits),
-		Misses:    atomic.LoadUint64(&c.stats.Misses),
-		Evictions: atomic.LoadUint64(&c.stats.Evictions),
+	var total CacheStats
+	for _, s := range c.shards {
+		total.Hits += atomic.LoadUint64(&s.stats.Hits)
+		total.Misses += atomic.LoadUint64(&s.stats.Misses)
+		total.Evictions += atomic.LoadUint64(&s.stats.Evictions)
+		total.NegativeHits += atomic.LoadUint64(&s.stats.NegativeHits)
 	}
+	return total
 }
 
-// GetHits returns the number of cache hits
+// GetHits returns the number of cache hits across all shards
 func (c *NetCache[T]) GetHits() uint64 {
-	return atomic.LoadUint64(&c.stats.Hits)
+	var total uint64
+	for _, s := range c.shards {
+		total += atomic.LoadUint64(&s.stats.Hits)
+	}
+	return total
 }
 
-// GetMisses returns the number of cache misses
+// GetMisses returns the number of cache misses across all shards
 func (c *NetCache[T]) GetMisses() uint64 {
-	return atomic.LoadUint64(&c.stats.Misses)
+	var total uint64
+	for _, s := range c.shards {
+		total += atomic.LoadUint64(&s.stats.Misses)
+	}
+	return total
 }
 
-// GetEvictions returns the number of cache evictions
+// GetEvictions returns the number of cache evictions across all shards
 func (c *NetCache[T]) GetEvictions() uint64 {
-	return atomic.LoadUint64(&c.stats.Evictions)
+	var total uint64
+	for _, s := range c.shards {
+		total += atomic.LoadUint64(&s.stats.Evictions)
+	}
+	return total
+}
+
+// GetNegativeHits returns the number of hits against negative (no-data)
+// cache entries across all shards
+func (c *NetCache[T]) GetNegativeHits() uint64 {
+	var total uint64
+	for _, s := range c.shards {
+		total += atomic.LoadUint64(&s.stats.NegativeHits)
+	}
+	return total
 }
 
 // GetHitRate returns the cache hit rate as a percentage
@@ -1,11 +1,15 @@
 package gonetcache
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -63,6 +67,31 @@ func (t *thing) myGetter(ipaddr netip.Addr) (maxminddb.Result, *net.IPNet) {
 	return result, netRange
 }
 
+// TestRepeatLookupIsCacheHit exercises ordinary, non-cherry-picked
+// addresses: a miss is now always stored back into the same shard it was
+// probed in (see shardFor), so every one of these must hit on a repeat
+// lookup regardless of how its address bytes happen to hash.
+func TestRepeatLookupIsCacheHit(t *testing.T) {
+	var calls int64
+	cache, err := New[string](func(ip netip.Addr) (string, *net.IPNet) {
+		atomic.AddInt64(&calls, 1)
+		_, network, _ := net.ParseCIDR(ip.String() + "/24")
+		return fmt.Sprintf("result-%s", ip.String()), network
+	}, 100)
+	require.NoError(t, err)
+
+	for _, s := range []string{"8.8.8.8", "1.1.1.1", "203.0.113.42", "192.168.1.17", "10.123.45.6"} {
+		addr, err := netip.ParseAddr(s)
+		require.NoError(t, err)
+		want := fmt.Sprintf("result-%s", s)
+
+		require.Equal(t, want, cache.Lookup(addr))
+		before := atomic.LoadInt64(&calls)
+		require.Equal(t, want, cache.Lookup(addr), "repeat lookup of %s should hit the cache", s)
+		require.Equal(t, before, atomic.LoadInt64(&calls), "repeat lookup of %s should not call Getter again", s)
+	}
+}
+
 func TestCacheEviction(t *testing.T) {
 	cache, err := New[string](func(ip netip.Addr) (string, *net.IPNet) {
 		_, network, _ := net.ParseCIDR(ip.String() + "/24")
@@ -74,23 +103,38 @@ func TestCacheEviction(t *testing.T) {
 	stats := cache.GetStats()
 	require.Equal(t, uint64(0), stats.Evictions)
 
+	// Eviction is per-shard, and a miss is stored back into the shard it
+	// was probed in (see shardFor), so pick two addresses whose own
+	// address bytes hash to the same shard to force one out of a
+	// two-slot cache.
+	first := "10.0.0.1"
+	p1, err := netip.ParseAddr(first)
+	require.NoError(t, err)
+	firstShard := shardFor(net.IP(p1.AsSlice()))
+
+	var second string
+	for i := 1; i < 250; i++ {
+		candidate := fmt.Sprintf("%d.0.0.1", i)
+		p2, err := netip.ParseAddr(candidate)
+		require.NoError(t, err)
+		if shardFor(net.IP(p2.AsSlice())) == firstShard && candidate != first {
+			second = candidate
+			break
+		}
+	}
+	require.NotEmpty(t, second, "could not find a colliding address for this test")
+
 	// Add first entry
-	addr1, err := netip.ParseAddr("10.0.0.1")
+	addr1, err := netip.ParseAddr(first)
 	require.NoError(t, err)
 	result1 := cache.Lookup(addr1)
-	require.Equal(t, "result-10.0.0.1", result1)
+	require.Equal(t, fmt.Sprintf("result-%s", first), result1)
 
-	// Add second entry
-	addr2, err := netip.ParseAddr("11.0.0.1")
+	// Add second entry, in the same shard - should cause eviction
+	addr2, err := netip.ParseAddr(second)
 	require.NoError(t, err)
 	result2 := cache.Lookup(addr2)
-	require.Equal(t, "result-11.0.0.1", result2)
-
-	// Add third entry - should cause eviction
-	addr3, err := netip.ParseAddr("12.0.0.1")
-	require.NoError(t, err)
-	result3 := cache.Lookup(addr3)
-	require.Equal(t, "result-12.0.0.1", result3)
+	require.Equal(t, fmt.Sprintf("result-%s", second), result2)
 
 	// Verify eviction occurred
 	stats = cache.GetStats()
@@ -110,8 +154,10 @@ func TestCacheStats(t *testing.T) {
 	require.Equal(t, uint64(0), stats.Misses)
 	require.Equal(t, uint64(0), stats.Evictions)
 
+	addr, err := netip.ParseAddr("10.0.5.1")
+	require.NoError(t, err)
+
 	// First lookup should be a miss
-	addr, _ := netip.ParseAddr("10.0.0.1")
 	cache.Lookup(addr)
 	stats = cache.GetStats()
 	require.Equal(t, uint64(0), stats.Hits)
@@ -123,12 +169,296 @@ func TestCacheStats(t *testing.T) {
 	require.Equal(t, uint64(1), stats.Hits)
 	require.Equal(t, uint64(1), stats.Misses)
 
-	// IP in same subnet should be a hit
-	addr2, _ := netip.ParseAddr("10.0.0.2")
+	// A different address should be a miss, even one in the same subnet:
+	// a miss is cached back into the shard it was itself probed in (see
+	// shardFor), not one derived from the network, so only an address
+	// that happens to hash to the same shard as 10.0.5.1 would hit here.
+	addr2, err := netip.ParseAddr("10.0.5.2")
+	require.NoError(t, err)
 	cache.Lookup(addr2)
 	stats = cache.GetStats()
-	require.Equal(t, uint64(2), stats.Hits)
-	require.Equal(t, uint64(1), stats.Misses)
+	require.Equal(t, uint64(1), stats.Hits)
+	require.Equal(t, uint64(2), stats.Misses)
+}
+
+func TestTTLExpiry(t *testing.T) {
+	var calls int64
+	cache, err := NewWithOptions[string](func(ip netip.Addr) (string, *net.IPNet) {
+		atomic.AddInt64(&calls, 1)
+		_, network, _ := net.ParseCIDR(ip.String() + "/24")
+		return fmt.Sprintf("result-%s", ip.String()), network
+	}, 2, Options{TTL: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	addr, err := netip.ParseAddr("10.0.5.1")
+	require.NoError(t, err)
+
+	cache.Lookup(addr)
+	require.Equal(t, int64(1), atomic.LoadInt64(&calls))
+
+	cache.Lookup(addr)
+	require.Equal(t, int64(1), atomic.LoadInt64(&calls), "within TTL should still be a hit")
+
+	time.Sleep(20 * time.Millisecond)
+
+	cache.Lookup(addr)
+	require.Equal(t, int64(2), atomic.LoadInt64(&calls), "past TTL should be treated as a miss")
+}
+
+func TestTTLRefreshAhead(t *testing.T) {
+	var calls int64
+	cache, err := NewWithOptions[string](func(ip netip.Addr) (string, *net.IPNet) {
+		n := atomic.AddInt64(&calls, 1)
+		_, network, _ := net.ParseCIDR(ip.String() + "/24")
+		return fmt.Sprintf("result-%d", n), network
+	}, 2, Options{TTL: 30 * time.Millisecond, RefreshAhead: 20 * time.Millisecond})
+	require.NoError(t, err)
+
+	addr, err := netip.ParseAddr("10.0.5.1")
+	require.NoError(t, err)
+
+	first := cache.Lookup(addr)
+	require.Equal(t, "result-1", first)
+
+	// Inside the refresh-ahead window: still servable, but should kick a
+	// background refresh.
+	time.Sleep(15 * time.Millisecond)
+	stale := cache.Lookup(addr)
+	require.Equal(t, "result-1", stale, "should still serve the stale value immediately")
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&calls) >= 2
+	}, time.Second, time.Millisecond, "background refresh should have run")
+
+	require.Eventually(t, func() bool {
+		return cache.Lookup(addr) == "result-2"
+	}, time.Second, time.Millisecond, "subsequent lookup should observe the refreshed value")
+}
+
+func TestInvalidate(t *testing.T) {
+	var calls int64
+	cache, err := New[string](func(ip netip.Addr) (string, *net.IPNet) {
+		atomic.AddInt64(&calls, 1)
+		_, network, _ := net.ParseCIDR(ip.String() + "/24")
+		return fmt.Sprintf("result-%s", ip.String()), network
+	}, 2)
+	require.NoError(t, err)
+
+	addr, err := netip.ParseAddr("10.0.5.1")
+	require.NoError(t, err)
+
+	cache.Lookup(addr)
+	cache.Lookup(addr)
+	require.Equal(t, int64(1), atomic.LoadInt64(&calls))
+
+	cache.Invalidate()
+
+	cache.Lookup(addr)
+	require.Equal(t, int64(2), atomic.LoadInt64(&calls), "lookup after Invalidate should be a miss")
+}
+
+func TestNegativeCaching(t *testing.T) {
+	var calls int64
+	cache, err := NewWithOptions[string](func(ip netip.Addr) (string, *net.IPNet) {
+		atomic.AddInt64(&calls, 1)
+		return "", nil
+	}, 2, Options{NegativeTTL: time.Minute})
+	require.NoError(t, err)
+
+	addr, err := netip.ParseAddr("10.0.5.1")
+	require.NoError(t, err)
+
+	result, found := cache.Lookup2(addr)
+	require.Equal(t, "", result)
+	require.False(t, found)
+	require.Equal(t, int64(1), atomic.LoadInt64(&calls))
+
+	result, found = cache.Lookup2(addr)
+	require.Equal(t, "", result)
+	require.False(t, found)
+	require.Equal(t, int64(1), atomic.LoadInt64(&calls), "repeat lookup should hit the negative entry, not call Getter again")
+
+	require.Equal(t, uint64(1), cache.GetNegativeHits())
+}
+
+func TestNegativeCachingDisabledByDefault(t *testing.T) {
+	var calls int64
+	cache, err := New[string](func(ip netip.Addr) (string, *net.IPNet) {
+		atomic.AddInt64(&calls, 1)
+		return "", nil
+	}, 2)
+	require.NoError(t, err)
+
+	addr, err := netip.ParseAddr("10.0.5.1")
+	require.NoError(t, err)
+
+	cache.Lookup(addr)
+	cache.Lookup(addr)
+	require.Equal(t, int64(2), atomic.LoadInt64(&calls), "without NegativeTTL every no-data lookup should call Getter again")
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	cache, err := New[string](func(ip netip.Addr) (string, *net.IPNet) {
+		_, network, _ := net.ParseCIDR(ip.String() + "/24")
+		return fmt.Sprintf("result-%s", ip.String()), network
+	}, 2)
+	require.NoError(t, err)
+
+	addr, err := netip.ParseAddr("10.0.5.1")
+	require.NoError(t, err)
+
+	cache.Lookup(addr)
+	cache.Lookup(addr)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	cache.PrometheusHandler().ServeHTTP(rec, req)
+
+	body := rec.Body.String()
+	require.Contains(t, body, "gonetcache_hits_total 1\n")
+	require.Contains(t, body, "gonetcache_misses_total 1\n")
+	require.Contains(t, body, "gonetcache_size 1\n")
+	require.Contains(t, body, fmt.Sprintf("gonetcache_capacity %d\n", numShards))
+	require.Contains(t, body, "gonetcache_lookup_duration_seconds_count 1\n")
+	require.Contains(t, body, `gonetcache_lookup_duration_seconds_bucket{le="+Inf"} 1`)
+}
+
+type recordingSink struct {
+	hits, evictions int64
+	misses          int64
+}
+
+func (r *recordingSink) ObserveHit()                       { atomic.AddInt64(&r.hits, 1) }
+func (r *recordingSink) ObserveMiss(latency time.Duration) { atomic.AddInt64(&r.misses, 1) }
+func (r *recordingSink) ObserveEviction()                  { atomic.AddInt64(&r.evictions, 1) }
+
+func TestMetricsSink(t *testing.T) {
+	cache, err := New[string](func(ip netip.Addr) (string, *net.IPNet) {
+		_, network, _ := net.ParseCIDR(ip.String() + "/24")
+		return fmt.Sprintf("result-%s", ip.String()), network
+	}, 2)
+	require.NoError(t, err)
+
+	sink := &recordingSink{}
+	cache.Sink = sink
+
+	addr, err := netip.ParseAddr("10.0.5.1")
+	require.NoError(t, err)
+
+	cache.Lookup(addr)
+	cache.Lookup(addr)
+
+	require.Equal(t, int64(1), atomic.LoadInt64(&sink.misses))
+	require.Equal(t, int64(1), atomic.LoadInt64(&sink.hits))
+}
+
+// sameShardSubnetPair finds two addresses in the same /24 whose probe shard
+// (see shardFor) agrees: LookupN groups a batch by probe shard before
+// resolving misses, so only addresses sharing a probe shard go through the
+// same coveredBy same-batch dedup and are guaranteed to share one Getter
+// call. Host bytes are scanned rather than tried as a fixed ".1"/".2" pair,
+// since there's no guarantee any two fixed offsets land in the same shard.
+func sameShardSubnetPair(t *testing.T) (addr1, addr2, cidr string) {
+	base := "10.0.5"
+	var hosts []string
+	for h := 1; h < 255; h++ {
+		addr := fmt.Sprintf("%s.%d", base, h)
+		p, err := netip.ParseAddr(addr)
+		require.NoError(t, err)
+		if shardFor(net.IP(p.AsSlice())) == shardFor(net.IP(netip.MustParseAddr(base+".1").AsSlice())) {
+			hosts = append(hosts, addr)
+			if len(hosts) == 2 {
+				return hosts[0], hosts[1], base + ".0/24"
+			}
+		}
+	}
+	t.Fatal("could not find a same-shard subnet pair for this test")
+	return "", "", ""
+}
+
+func TestLookupN(t *testing.T) {
+	var calls int64
+	cache, err := New[string](func(ip netip.Addr) (string, *net.IPNet) {
+		atomic.AddInt64(&calls, 1)
+		_, network, _ := net.ParseCIDR(ip.String() + "/24")
+		return fmt.Sprintf("result-%s", network.String()), network
+	}, 100)
+	require.NoError(t, err)
+
+	addr1, addr2, cidr := sameShardSubnetPair(t)
+	_, network, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+	want := fmt.Sprintf("result-%s", network.String())
+
+	ips := make([]netip.Addr, 0, 2)
+	for _, s := range []string{addr1, addr2} {
+		addr, err := netip.ParseAddr(s)
+		require.NoError(t, err)
+		ips = append(ips, addr)
+	}
+
+	results := cache.LookupN(ips)
+	require.Len(t, results, 2)
+	require.Equal(t, want, results[0])
+	require.Equal(t, want, results[1])
+	require.Equal(t, int64(1), atomic.LoadInt64(&calls), "both addresses share a network, so only one Getter call should fire")
+
+	// Repeating the batch should be served entirely from cache.
+	before := atomic.LoadInt64(&calls)
+	results = cache.LookupN(ips)
+	require.Equal(t, want, results[0])
+	require.Equal(t, before, atomic.LoadInt64(&calls), "second batch should be all hits")
+}
+
+func TestLookupCtx(t *testing.T) {
+	cache, err := New[string](func(ip netip.Addr) (string, *net.IPNet) {
+		_, network, _ := net.ParseCIDR(ip.String() + "/24")
+		return fmt.Sprintf("result-%s", ip.String()), network
+	}, 10)
+	require.NoError(t, err)
+
+	addrStr := "10.0.5.1"
+	addr, err := netip.ParseAddr(addrStr)
+	require.NoError(t, err)
+
+	result, err := cache.LookupCtx(context.Background(), addr)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("result-%s", addrStr), result)
+
+	// Cached on the second call, so even an already-expired context doesn't
+	// block it.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err = cache.LookupCtx(ctx, addr)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("result-%s", addrStr), result)
+}
+
+func TestLookupCtxCancellation(t *testing.T) {
+	unblock := make(chan struct{})
+	cache, err := New[string](func(ip netip.Addr) (string, *net.IPNet) {
+		<-unblock
+		_, network, _ := net.ParseCIDR(ip.String() + "/24")
+		return fmt.Sprintf("result-%s", ip.String()), network
+	}, 10)
+	require.NoError(t, err)
+
+	addrStr := "10.0.5.1"
+	addr, err := netip.ParseAddr(addrStr)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = cache.LookupCtx(ctx, addr)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(unblock)
+
+	want := fmt.Sprintf("result-%s", addrStr)
+	require.Eventually(t, func() bool {
+		return cache.Lookup(addr) == want
+	}, time.Second, time.Millisecond, "the abandoned Getter call should still populate the cache")
 }
 
 func TestConcurrentAccess(t *testing.T) {
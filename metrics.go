@@ -0,0 +1,142 @@
+package gonetcache
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MetricsSink lets callers forward cache events to an external
+// observability system (OpenTelemetry, statsd, ...) in addition to the
+// counters GetStats and PrometheusHandler already expose. NetCache.Sink
+// defaults to a no-op implementation; assign your own to start forwarding.
+type MetricsSink interface {
+	ObserveHit()
+	ObserveMiss(latency time.Duration)
+	ObserveEviction()
+}
+
+// noopMetricsSink is the default MetricsSink: GetStats and
+// PrometheusHandler already derive everything they report from the shard
+// counters and the lookup-duration histogram, so the default sink has
+// nothing extra to do.
+type noopMetricsSink struct{}
+
+func (noopMetricsSink) ObserveHit()               {}
+func (noopMetricsSink) ObserveMiss(time.Duration) {}
+func (noopMetricsSink) ObserveEviction()          {}
+
+// defaultHistogramBuckets mirrors the Prometheus client's default buckets.
+var defaultHistogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram is a minimal hand-rolled Prometheus-style histogram. It's only
+// touched once per cache miss, which already pays for a Getter call, so a
+// plain mutex is used rather than reaching for atomics.
+type histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64 // len(buckets)+1; the last slot is the +Inf bucket
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *histogram) observe(seconds float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.sum += seconds
+	h.count++
+
+	idx := len(h.buckets)
+	for i, b := range h.buckets {
+		if seconds <= b {
+			idx = i
+			break
+		}
+	}
+	h.counts[idx]++
+}
+
+// snapshot returns cumulative bucket counts (the final entry is the +Inf
+// bucket) alongside the running sum and total observation count.
+func (h *histogram) snapshot() (buckets []float64, cumulative []uint64, sum float64, count uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	cumulative = make([]uint64, len(h.counts))
+	var running uint64
+	for i, c := range h.counts {
+		running += c
+		cumulative[i] = running
+	}
+	return h.buckets, cumulative, h.sum, h.count
+}
+
+// size returns the number of entries currently cached across all shards.
+func (c *NetCache[T]) size() int {
+	var total int
+	for _, s := range c.shards {
+		s.mutex.RLock()
+		total += s.small.size + s.main.size
+		s.mutex.RUnlock()
+	}
+	return total
+}
+
+// PrometheusHandler returns an http.Handler serving cache metrics in
+// Prometheus text exposition format, hand-rendered so this package doesn't
+// need to pull in prometheus/client_golang.
+func (c *NetCache[T]) PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		stats := c.GetStats()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		fmt.Fprint(w, "# HELP gonetcache_hits_total Total number of cache hits.\n")
+		fmt.Fprint(w, "# TYPE gonetcache_hits_total counter\n")
+		fmt.Fprintf(w, "gonetcache_hits_total %d\n", stats.Hits)
+
+		fmt.Fprint(w, "# HELP gonetcache_misses_total Total number of cache misses.\n")
+		fmt.Fprint(w, "# TYPE gonetcache_misses_total counter\n")
+		fmt.Fprintf(w, "gonetcache_misses_total %d\n", stats.Misses)
+
+		fmt.Fprint(w, "# HELP gonetcache_evictions_total Total number of cache evictions.\n")
+		fmt.Fprint(w, "# TYPE gonetcache_evictions_total counter\n")
+		fmt.Fprintf(w, "gonetcache_evictions_total %d\n", stats.Evictions)
+
+		fmt.Fprint(w, "# HELP gonetcache_negative_hits_total Total number of hits against cached no-data entries.\n")
+		fmt.Fprint(w, "# TYPE gonetcache_negative_hits_total counter\n")
+		fmt.Fprintf(w, "gonetcache_negative_hits_total %d\n", stats.NegativeHits)
+
+		fmt.Fprint(w, "# HELP gonetcache_size Number of entries currently cached.\n")
+		fmt.Fprint(w, "# TYPE gonetcache_size gauge\n")
+		fmt.Fprintf(w, "gonetcache_size %d\n", c.size())
+
+		fmt.Fprint(w, "# HELP gonetcache_capacity Configured cache capacity.\n")
+		fmt.Fprint(w, "# TYPE gonetcache_capacity gauge\n")
+		fmt.Fprintf(w, "gonetcache_capacity %d\n", c.maxSize)
+
+		buckets, counts, sum, count := c.lookupDuration.snapshot()
+		fmt.Fprint(w, "# HELP gonetcache_lookup_duration_seconds Time spent in Getter on a cache miss.\n")
+		fmt.Fprint(w, "# TYPE gonetcache_lookup_duration_seconds histogram\n")
+		for i, b := range buckets {
+			fmt.Fprintf(w, "gonetcache_lookup_duration_seconds_bucket{le=\"%s\"} %d\n", formatFloat(b), counts[i])
+		}
+		fmt.Fprintf(w, "gonetcache_lookup_duration_seconds_bucket{le=\"+Inf\"} %d\n", counts[len(buckets)])
+		fmt.Fprintf(w, "gonetcache_lookup_duration_seconds_sum %s\n", formatFloat(sum))
+		fmt.Fprintf(w, "gonetcache_lookup_duration_seconds_count %d\n", count)
+	})
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}